@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+
+	"github.com/nikolas/windsock/pkg/auth"
+)
+
+// Hub manages many named signaling rooms, as opposed to the single
+// global pub/sub room the protocol=legacy path still uses. Clients
+// join/leave rooms explicitly over a JSON control plane instead of
+// being routed implicitly by sub-prefix.
+type Hub struct {
+	mu    sync.Mutex
+	rooms map[string]*signalingRoom
+}
+
+type signalingRoom struct {
+	name  string
+	users map[*OnlineUser]bool
+}
+
+// NewHub returns an empty Hub.
+func NewHub() *Hub {
+	return &Hub{rooms: make(map[string]*signalingRoom)}
+}
+
+var runningHub = NewHub()
+
+func (h *Hub) join(name string, u *OnlineUser) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r, ok := h.rooms[name]
+	if !ok {
+		r = &signalingRoom{name: name, users: make(map[*OnlineUser]bool)}
+		h.rooms[name] = r
+	}
+	r.users[u] = true
+}
+
+func (h *Hub) leave(name string, u *OnlineUser) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r, ok := h.rooms[name]
+	if !ok {
+		return
+	}
+	delete(r.users, u)
+	if len(r.users) == 0 {
+		delete(h.rooms, name)
+	}
+}
+
+// leaveAll removes u from every room it's in, returning the names of
+// the rooms it was a member of.
+func (h *Hub) leaveAll(u *OnlineUser) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var names []string
+	for name, r := range h.rooms {
+		if _, ok := r.users[u]; !ok {
+			continue
+		}
+		delete(r.users, u)
+		names = append(names, name)
+		if len(r.users) == 0 {
+			delete(h.rooms, name)
+		}
+	}
+	return names
+}
+
+func (h *Hub) members(name string) []*OnlineUser {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r, ok := h.rooms[name]
+	if !ok {
+		return nil
+	}
+	members := make([]*OnlineUser, 0, len(r.users))
+	for u := range r.users {
+		members = append(members, u)
+	}
+	return members
+}
+
+// isMember reports whether u is currently joined to room name. A
+// token's "op"/"record" permission bits are only meaningful within
+// rooms the connection has actually joined, so callers gating on them
+// must check this too.
+func (h *Hub) isMember(name string, u *OnlineUser) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	r, ok := h.rooms[name]
+	if !ok {
+		return false
+	}
+	return r.users[u]
+}
+
+// uniList returns the UNIs of everyone currently present in name, for
+// presence broadcasts.
+func (h *Hub) uniList(name string) []string {
+	members := h.members(name)
+	unis := make([]string, 0, len(members))
+	for _, u := range members {
+		unis = append(unis, u.Uci.Uni)
+	}
+	return unis
+}
+
+// broadcast sends msg to every member of name except exclude (if non-nil).
+func (h *Hub) broadcast(name string, msg interface{}, exclude *OnlineUser) {
+	for _, u := range h.members(name) {
+		if u == exclude {
+			continue
+		}
+		u.Enqueue(msg)
+	}
+}
+
+// control-plane message shapes
+
+type controlMessage struct {
+	Type    string          `json:"type"`
+	Room    string          `json:"room,omitempty"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Action  string          `json:"action,omitempty"`
+	Target  string          `json:"target,omitempty"`
+}
+
+type joinedMessage struct {
+	Type string `json:"type"`
+	Room string `json:"room"`
+}
+
+type usersMessage struct {
+	Type  string   `json:"type"`
+	Room  string   `json:"room"`
+	Users []string `json:"users"`
+}
+
+type userMessage struct {
+	Type   string `json:"type"`
+	Kind   string `json:"kind"`
+	Room   string `json:"room"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type roomMessage struct {
+	Type    string          `json:"type"`
+	Room    string          `json:"room"`
+	From    string          `json:"from"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Content string          `json:"content,omitempty"`
+}
+
+func hasPermission(uci auth.ConnectionInfo, perm string) bool {
+	for _, p := range uci.Permissions {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// buildSignalingConnection runs the default (non-legacy) protocol: a
+// JSON control plane over the websocket for joining/leaving/messaging
+// named rooms instead of implicit sub-prefix routing.
+func buildSignalingConnection(ws *websocket.Conn, uci auth.ConnectionInfo, expiry time.Time, version string) {
+	onlineUser := &OnlineUser{
+		Connection: ws,
+		Uci:        uci,
+		Expiry:     expiry,
+		Send:       make(chan interface{}, sendQueueSize),
+		done:       make(chan struct{}),
+	}
+	numClients.Add(1)
+	totalClients.Add(1)
+	go onlineUser.PushToClient()
+	if checker := effectiveAuthzChecker(version); checker != nil {
+		go onlineUser.reauthLoop(checker, reauthInterval)
+	}
+
+	runSignalingLoop(onlineUser)
+
+	close(onlineUser.done)
+	for _, name := range runningHub.leaveAll(onlineUser) {
+		runningHub.broadcast(name, usersMessage{Type: "users", Room: name, Users: runningHub.uniList(name)}, nil)
+	}
+	numClients.Add(-1)
+	log.Info("tore down signaling connection")
+}
+
+func runSignalingLoop(u *OnlineUser) {
+	compressAllowed := hasPermission(u.Uci, "compress")
+	u.Connection.SetReadDeadline(time.Now().Add(pongWait))
+	u.Connection.SetPongHandler(func(string) error {
+		u.Connection.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+	for {
+		_, data, err := u.Connection.ReadMessage()
+		if err != nil {
+			return
+		}
+		recordIncomingBytes(len(data), compressAllowed)
+
+		var msg controlMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.WithFields(log.Fields{"error": err}).Warn("couldn't parse control message")
+			continue
+		}
+		handleControlMessage(u, msg)
+	}
+}
+
+func handleControlMessage(u *OnlineUser, msg controlMessage) {
+	switch msg.Type {
+	case "join":
+		if !hasPermission(u.Uci, "present") {
+			u.Enqueue(userMessage{Type: "usermessage", Kind: "error", Room: msg.Room, Reason: "not authorized to join"})
+			return
+		}
+		runningHub.join(msg.Room, u)
+		u.Enqueue(joinedMessage{Type: "joined", Room: msg.Room})
+		runningHub.broadcast(msg.Room, usersMessage{Type: "users", Room: msg.Room, Users: runningHub.uniList(msg.Room)}, nil)
+	case "leave":
+		runningHub.leave(msg.Room, u)
+		runningHub.broadcast(msg.Room, usersMessage{Type: "users", Room: msg.Room, Users: runningHub.uniList(msg.Room)}, nil)
+	case "message":
+		if !hasPermission(u.Uci, "present") || !runningHub.isMember(msg.Room, u) {
+			u.Enqueue(userMessage{Type: "usermessage", Kind: "error", Room: msg.Room, Reason: "not authorized to message room"})
+			return
+		}
+		runningHub.broadcast(msg.Room, roomMessage{Type: "message", Room: msg.Room, From: u.Uci.Uni, Payload: msg.Payload}, u)
+	case "op":
+		handleOp(u, msg)
+	case "record":
+		handleRecord(u, msg)
+	default:
+		log.WithFields(log.Fields{"type": msg.Type}).Warn("unknown control message type")
+	}
+}
+
+func handleOp(u *OnlineUser, msg controlMessage) {
+	// the "op" bit only grants authority inside rooms u has actually
+	// joined, not globally across every room on the Hub.
+	if !hasPermission(u.Uci, "op") || !runningHub.isMember(msg.Room, u) {
+		u.Enqueue(userMessage{Type: "usermessage", Kind: "error", Room: msg.Room, Reason: "not authorized to operate on room"})
+		return
+	}
+	switch msg.Action {
+	case "kick":
+		for _, target := range runningHub.members(msg.Room) {
+			if target.Uci.Uni != msg.Target {
+				continue
+			}
+			target.Enqueue(userMessage{Type: "usermessage", Kind: "kick", Room: msg.Room, Reason: "kicked by operator"})
+			runningHub.leave(msg.Room, target)
+			target.forceDisconnect(closeKicked, "kicked by operator")
+			runningHub.broadcast(msg.Room, usersMessage{Type: "users", Room: msg.Room, Users: runningHub.uniList(msg.Room)}, nil)
+			return
+		}
+	default:
+		log.WithFields(log.Fields{"action": msg.Action}).Warn("unknown op action")
+	}
+}
+
+// handleRecord lets a client with the "record" permission announce a
+// recording state change (msg.Action, e.g. "start"/"stop") to the rest
+// of a room it has joined. Like "op", the bit only grants authority
+// inside rooms u has actually joined, not globally across the Hub.
+// windsock itself doesn't capture any media or bytes; it just relays
+// the announcement so room members can show a recording indicator.
+func handleRecord(u *OnlineUser, msg controlMessage) {
+	if !hasPermission(u.Uci, "record") || !runningHub.isMember(msg.Room, u) {
+		u.Enqueue(userMessage{Type: "usermessage", Kind: "error", Room: msg.Room, Reason: "not authorized to record room"})
+		return
+	}
+	runningHub.broadcast(msg.Room, roomMessage{Type: "record", Room: msg.Room, From: u.Uci.Uni, Content: msg.Action}, nil)
+}
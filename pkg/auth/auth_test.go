@@ -0,0 +1,20 @@
+package auth
+
+import "testing"
+
+func TestVersionDoesNotMisrouteV0TokenWithDots(t *testing.T) {
+	// a v0 token's fields (its embedded IP address in particular)
+	// routinely contain dots; a token with exactly two dots in total, as
+	// here, used to be enough on its own to misroute it to the JWT path.
+	token := "gobot:sub:pub:1000:salt:1.2.3:deadbeef"
+	if got := Version(token); got != "v0" {
+		t.Fatalf("expected v0 token with dotted IP to be classified as v0, got %q", got)
+	}
+}
+
+func TestVersionStillDetectsJWT(t *testing.T) {
+	token := "eyJhbGciOiJSUzI1NiJ9.eyJ1bmkiOiJnb2JvdCJ9.c2ln"
+	if got := Version(token); got != "jwt" {
+		t.Fatalf("expected token to be classified as jwt, got %q", got)
+	}
+}
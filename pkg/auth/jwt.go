@@ -0,0 +1,237 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// JWTVerifier checks RS256/ES256-signed JWTs against public keys
+// published by a JWKS endpoint, so tokens can be issued by an external
+// identity provider instead of a shared HMAC secret.
+type JWTVerifier struct {
+	JWKSURL    string
+	HTTPClient *http.Client
+	CacheFor   time.Duration
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+}
+
+// NewJWTVerifier returns a verifier that fetches its signing keys from
+// jwksURL, re-fetching them once cacheFor has passed since the last
+// successful fetch. While a refresh keeps failing, every call retries
+// the fetch and falls back to the previously fetched keys.
+func NewJWTVerifier(jwksURL string, cacheFor time.Duration) *JWTVerifier {
+	return &JWTVerifier{
+		JWKSURL:    jwksURL,
+		HTTPClient: http.DefaultClient,
+		CacheFor:   cacheFor,
+	}
+}
+
+type jwkSet struct {
+	Keys []jwk `json:"keys"`
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (v *JWTVerifier) publicKey(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.keys == nil || time.Since(v.fetchedAt) > v.CacheFor {
+		keys, err := v.fetchKeys()
+		if err != nil {
+			// keep serving the stale key set if we have one
+			if v.keys != nil {
+				log.WithFields(log.Fields{"error": err}).Warn("failed to refresh JWKS, using stale keys")
+			} else {
+				return nil, err
+			}
+		} else {
+			v.keys = keys
+			v.fetchedAt = time.Now()
+		}
+	}
+
+	key, ok := v.keys[kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+func (v *JWTVerifier) fetchKeys() (map[string]crypto.PublicKey, error) {
+	resp, err := v.HTTPClient.Get(v.JWKSURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var set jwkSet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, k := range set.Keys {
+		pub, err := k.publicKey()
+		if err != nil {
+			log.WithFields(log.Fields{"kid": k.Kid, "error": err}).Warn("skipping unparseable JWKS entry")
+			continue
+		}
+		keys[k.Kid] = pub
+	}
+	return keys, nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64URLBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64URLBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, ErrUnsupportedAlg
+		}
+		x, err := base64URLBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64URLBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	default:
+		return nil, ErrUnsupportedAlg
+	}
+}
+
+func base64URLBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type jwtClaims struct {
+	Uni          string   `json:"uni"`
+	SubPrefix    string   `json:"sub_prefix"`
+	PubPrefix    string   `json:"pub_prefix"`
+	TunnelPolicy []string `json:"tunnel_policy"`
+	Permissions  []string `json:"permissions"`
+	Exp          int64    `json:"exp"`
+}
+
+func (v *JWTVerifier) Verify(token string, now time.Time, remoteIP net.Addr) (ConnectionInfo, time.Time, error) {
+	var uci ConnectionInfo
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return uci, time.Time{}, ErrInvalidToken
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return uci, time.Time{}, ErrInvalidToken
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return uci, time.Time{}, ErrInvalidToken
+	}
+
+	if header.Alg != "RS256" && header.Alg != "ES256" {
+		return uci, time.Time{}, ErrUnsupportedAlg
+	}
+
+	key, err := v.publicKey(header.Kid)
+	if err != nil {
+		return uci, time.Time{}, err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return uci, time.Time{}, ErrInvalidToken
+	}
+	signed := parts[0] + "." + parts[1]
+	digest := sha256.Sum256([]byte(signed))
+
+	switch header.Alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return uci, time.Time{}, ErrUnsupportedAlg
+		}
+		if err := rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature); err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("JWT RS256 signature invalid")
+			return uci, time.Time{}, ErrInvalidToken
+		}
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return uci, time.Time{}, ErrUnsupportedAlg
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, digest[:], r, s) {
+			return uci, time.Time{}, ErrInvalidToken
+		}
+	}
+
+	payloadJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return uci, time.Time{}, ErrInvalidToken
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(payloadJSON, &claims); err != nil {
+		return uci, time.Time{}, ErrInvalidToken
+	}
+
+	expiry := time.Unix(claims.Exp, 0)
+	if now.After(expiry) {
+		return uci, time.Time{}, ErrStaleToken
+	}
+
+	uci.Uni = claims.Uni
+	uci.SubPrefix = claims.SubPrefix
+	uci.PubPrefix = claims.PubPrefix
+	uci.TunnelPolicy = claims.TunnelPolicy
+	uci.Permissions = claims.Permissions
+	return uci, expiry, nil
+}
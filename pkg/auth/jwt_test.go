@@ -0,0 +1,147 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestJWKSServer(t *testing.T, key *rsa.PrivateKey, kid string) *httptest.Server {
+	t.Helper()
+	set := jwkSet{Keys: []jwk{{
+		Kty: "RSA",
+		Kid: kid,
+		Alg: "RS256",
+		N:   base64.RawURLEncoding.EncodeToString(key.PublicKey.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.PublicKey.E)).Bytes()),
+	}}}
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(set)
+	}))
+}
+
+func signRS256(t *testing.T, key *rsa.PrivateKey, kid string, claims jwtClaims) string {
+	t.Helper()
+	header, err := json.Marshal(jwtHeader{Alg: "RS256", Kid: kid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTVerifierAccepts(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTestJWKSServer(t, key, "2024-01")
+	defer server.Close()
+
+	v := NewJWTVerifier(server.URL, time.Minute)
+	claims := jwtClaims{Uni: "gobot", SubPrefix: "gobot.browser", PubPrefix: "anp8", Exp: time.Now().Add(time.Hour).Unix()}
+	token := signRS256(t, key, "2024-01", claims)
+
+	uci, _, err := v.Verify(token, time.Now(), nil)
+	if err != nil {
+		t.Fatalf("expected valid JWT to verify, got %v", err)
+	}
+	if uci.Uni != "gobot" {
+		t.Fatalf("unexpected connection info: %+v", uci)
+	}
+}
+
+func TestJWTVerifierRejectsTamperedSignature(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTestJWKSServer(t, key, "2024-01")
+	defer server.Close()
+
+	v := NewJWTVerifier(server.URL, time.Minute)
+	claims := jwtClaims{Uni: "gobot", Exp: time.Now().Add(time.Hour).Unix()}
+	token := signRS256(t, key, "2024-01", claims)
+	// the last base64 character only carries two bits of the signature,
+	// so swap it for one that is guaranteed to differ.
+	last := "A"
+	if token[len(token)-1] == 'A' {
+		last = "Q"
+	}
+	tampered := token[:len(token)-1] + last
+
+	if _, _, err := v.Verify(tampered, time.Now(), nil); err != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken for tampered signature, got %v", err)
+	}
+}
+
+func TestJWTVerifierRejectsExpiredToken(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTestJWKSServer(t, key, "2024-01")
+	defer server.Close()
+
+	v := NewJWTVerifier(server.URL, time.Minute)
+	claims := jwtClaims{Uni: "gobot", Exp: time.Now().Add(-time.Hour).Unix()}
+	token := signRS256(t, key, "2024-01", claims)
+
+	if _, _, err := v.Verify(token, time.Now(), nil); err != ErrStaleToken {
+		t.Fatalf("expected ErrStaleToken for expired JWT, got %v", err)
+	}
+}
+
+func TestJWTVerifierRejectsUnknownKid(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTestJWKSServer(t, key, "2024-01")
+	defer server.Close()
+
+	v := NewJWTVerifier(server.URL, time.Minute)
+	claims := jwtClaims{Uni: "gobot", Exp: time.Now().Add(time.Hour).Unix()}
+	token := signRS256(t, key, "does-not-exist", claims)
+
+	if _, _, err := v.Verify(token, time.Now(), nil); err != ErrUnknownKey {
+		t.Fatalf("expected ErrUnknownKey, got %v", err)
+	}
+}
+
+func TestJWTVerifierRejectsUnsupportedAlg(t *testing.T) {
+	v := NewJWTVerifier("http://unused.invalid", time.Minute)
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","kid":"2024-01"}`))
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"uni":"gobot"}`))
+	token := fmt.Sprintf("%s.%s.%s", header, payload, base64.RawURLEncoding.EncodeToString([]byte("sig")))
+
+	if _, _, err := v.Verify(token, time.Now(), nil); err != ErrUnsupportedAlg {
+		t.Fatalf("expected ErrUnsupportedAlg, got %v", err)
+	}
+}
+
+func TestJWTVerifierRejectsMalformedToken(t *testing.T) {
+	v := NewJWTVerifier("http://unused.invalid", time.Minute)
+
+	if _, _, err := v.Verify("not-a-jwt", time.Now(), nil); err != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken for malformed JWT, got %v", err)
+	}
+}
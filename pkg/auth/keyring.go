@@ -0,0 +1,37 @@
+package auth
+
+// KeyRing holds the shared secrets verifiers sign/check HMACs against,
+// keyed by key id (kid) so operators can rotate secrets without a
+// coordinated deploy: a new secret is added under a new kid, tokens are
+// reissued against it, and the old kid is dropped once nothing is using
+// it anymore.
+type KeyRing struct {
+	secrets    map[string][]byte
+	defaultKid string
+}
+
+// NewKeyRing builds a KeyRing from a kid->secret map, such as the one
+// loaded from ConfigData. defaultKid is used for tokens that don't
+// carry a kid of their own (legacy v0 tokens).
+func NewKeyRing(secrets map[string]string, defaultKid string) *KeyRing {
+	k := &KeyRing{
+		secrets:    make(map[string][]byte, len(secrets)),
+		defaultKid: defaultKid,
+	}
+	for kid, secret := range secrets {
+		k.secrets[kid] = []byte(secret)
+	}
+	return k
+}
+
+// Secret returns the secret registered under kid.
+func (k *KeyRing) Secret(kid string) ([]byte, bool) {
+	s, ok := k.secrets[kid]
+	return s, ok
+}
+
+// DefaultSecret returns the secret for the ring's default kid, used by
+// verifiers that need a key before a kid has been negotiated.
+func (k *KeyRing) DefaultSecret() ([]byte, bool) {
+	return k.Secret(k.defaultKid)
+}
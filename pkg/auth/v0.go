@@ -0,0 +1,82 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// V0Verifier checks the original, unversioned token format:
+//
+//	uni:sub_prefix:pub_prefix:timestamp:salt:ip_address:hmac
+//
+// It is kept around purely for back-compat with tokens issued before
+// the v1 format existed; new issuers should prefer V1Verifier.
+type V0Verifier struct {
+	Keys   *KeyRing
+	Window time.Duration
+}
+
+// NewV0Verifier returns a verifier for legacy tokens, rejecting any
+// token whose embedded timestamp is more than window old.
+func NewV0Verifier(keys *KeyRing, window time.Duration) *V0Verifier {
+	return &V0Verifier{Keys: keys, Window: window}
+}
+
+func (v *V0Verifier) Verify(token string, now time.Time, remoteIP net.Addr) (ConnectionInfo, time.Time, error) {
+	var uci ConnectionInfo
+	parts := strings.Split(token, ":")
+	if len(parts) != 7 {
+		log.WithFields(log.Fields{
+			"token": token,
+			"parts": len(parts),
+		}).Error("couldn't parse token")
+		return uci, time.Time{}, ErrInvalidToken
+	}
+	uci.Uni = parts[0]
+	uci.SubPrefix = parts[1]
+	uci.PubPrefix = parts[2]
+
+	ts, err := strconv.Atoi(parts[3])
+	if err != nil {
+		log.WithFields(log.Fields{
+			"token":           token,
+			"timestamp_field": parts[3],
+			"error":           err,
+		}).Error("invalid timestamp in token")
+		return uci, time.Time{}, ErrInvalidToken
+	}
+	salt := parts[4]
+	ipAddress := parts[5]
+	hmc := parts[6]
+
+	tokenTime := time.Unix(int64(ts), 0)
+	if now.Sub(tokenTime) > v.Window {
+		log.Error("stale token")
+		return uci, time.Time{}, ErrStaleToken
+	}
+
+	secret, ok := v.Keys.DefaultSecret()
+	if !ok {
+		return uci, time.Time{}, ErrUnknownKey
+	}
+	h := hmac.New(sha1.New, secret)
+	h.Write([]byte(fmt.Sprintf("%s:%s:%s:%d:%s:%s", uci.Uni, uci.SubPrefix, uci.PubPrefix, ts, salt, ipAddress)))
+	sum := fmt.Sprintf("%x", h.Sum(nil))
+	if sum != hmc {
+		log.WithFields(log.Fields{
+			"token":      token,
+			"expected":   hmc,
+			"calculated": sum,
+		}).Error("token HMAC doesn't match")
+		return uci, time.Time{}, ErrInvalidToken
+	}
+
+	return uci, tokenTime.Add(v.Window), nil
+}
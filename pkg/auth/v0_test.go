@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func v0Token(secret []byte, uni, sub, pub string, ts int64, salt, ip string) string {
+	h := hmac.New(sha1.New, secret)
+	h.Write([]byte(fmt.Sprintf("%s:%s:%s:%d:%s:%s", uni, sub, pub, ts, salt, ip)))
+	mac := fmt.Sprintf("%x", h.Sum(nil))
+	return fmt.Sprintf("%s:%s:%s:%d:%s:%s:%s", uni, sub, pub, ts, salt, ip, mac)
+}
+
+func TestV0VerifierAccepts(t *testing.T) {
+	keys := NewKeyRing(map[string]string{"": "sekrit"}, "")
+	v := NewV0Verifier(keys, 60*time.Second)
+	now := time.Unix(1000, 0)
+	token := v0Token([]byte("sekrit"), "gobot", "gobot.browser", "anp8", now.Unix(), "salt", "1.2.3.4")
+
+	uci, _, err := v.Verify(token, now, nil)
+	if err != nil {
+		t.Fatalf("expected valid token to verify, got %v", err)
+	}
+	if uci.Uni != "gobot" || uci.SubPrefix != "gobot.browser" || uci.PubPrefix != "anp8" {
+		t.Fatalf("unexpected connection info: %+v", uci)
+	}
+}
+
+func TestV0VerifierRejectsTamperedMAC(t *testing.T) {
+	keys := NewKeyRing(map[string]string{"": "sekrit"}, "")
+	v := NewV0Verifier(keys, 60*time.Second)
+	now := time.Unix(1000, 0)
+	token := v0Token([]byte("sekrit"), "gobot", "gobot.browser", "anp8", now.Unix(), "salt", "1.2.3.4")
+	tampered := token[:len(token)-1] + "0"
+
+	if _, _, err := v.Verify(tampered, now, nil); err != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken for tampered MAC, got %v", err)
+	}
+}
+
+func TestV0VerifierRejectsStaleToken(t *testing.T) {
+	keys := NewKeyRing(map[string]string{"": "sekrit"}, "")
+	v := NewV0Verifier(keys, 60*time.Second)
+	issued := time.Unix(1000, 0)
+	token := v0Token([]byte("sekrit"), "gobot", "gobot.browser", "anp8", issued.Unix(), "salt", "1.2.3.4")
+
+	if _, _, err := v.Verify(token, issued.Add(time.Hour), nil); err != ErrStaleToken {
+		t.Fatalf("expected ErrStaleToken for expired token, got %v", err)
+	}
+}
+
+func TestV0VerifierRejectsMalformedToken(t *testing.T) {
+	keys := NewKeyRing(map[string]string{"": "sekrit"}, "")
+	v := NewV0Verifier(keys, 60*time.Second)
+
+	if _, _, err := v.Verify("not:enough:fields", time.Now(), nil); err != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken for malformed token, got %v", err)
+	}
+}
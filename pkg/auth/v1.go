@@ -0,0 +1,102 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// V1Verifier checks v1 tokens, which are a URL-encoded query string
+// carrying their own algorithm and key id so secrets and hash
+// functions can be rotated without a coordinated client/server
+// deploy, e.g.:
+//
+//	v=1&alg=HS256&kid=2024-01&uni=gobot&sub=gobot.browser.anp8&pub=anp8&ts=1344361884&salt=667494&mac=30623...
+type V1Verifier struct {
+	Keys   *KeyRing
+	Window time.Duration
+}
+
+// NewV1Verifier returns a verifier for v=1 tokens, rejecting any token
+// whose embedded timestamp is more than window old.
+func NewV1Verifier(keys *KeyRing, window time.Duration) *V1Verifier {
+	return &V1Verifier{Keys: keys, Window: window}
+}
+
+var v1Hashes = map[string]func() hash.Hash{
+	"HS256": sha256.New,
+	"HS512": sha512.New,
+}
+
+func (v *V1Verifier) Verify(token string, now time.Time, remoteIP net.Addr) (ConnectionInfo, time.Time, error) {
+	var uci ConnectionInfo
+	values, err := url.ParseQuery(token)
+	if err != nil {
+		log.WithFields(log.Fields{"token": token, "error": err}).Error("couldn't parse v1 token")
+		return uci, time.Time{}, ErrInvalidToken
+	}
+
+	alg := values.Get("alg")
+	newHash, ok := v1Hashes[alg]
+	if !ok {
+		log.WithFields(log.Fields{"token": token, "alg": alg}).Error("unsupported v1 algorithm")
+		return uci, time.Time{}, ErrUnsupportedAlg
+	}
+
+	kid := values.Get("kid")
+	secret, ok := v.Keys.Secret(kid)
+	if !ok {
+		log.WithFields(log.Fields{"token": token, "kid": kid}).Error("unknown key id in v1 token")
+		return uci, time.Time{}, ErrUnknownKey
+	}
+
+	uci.Uni = values.Get("uni")
+	uci.SubPrefix = values.Get("sub")
+	uci.PubPrefix = values.Get("pub")
+	if tunnels := values.Get("tunnels"); tunnels != "" {
+		uci.TunnelPolicy = strings.Split(tunnels, ",")
+	}
+	if perms := values.Get("perms"); perms != "" {
+		uci.Permissions = strings.Split(perms, ",")
+	}
+	mac := values.Get("mac")
+	signedPrefix := strings.TrimSuffix(token, "&mac="+mac)
+	if signedPrefix == token {
+		log.WithFields(log.Fields{"token": token}).Error("v1 token missing trailing mac field")
+		return uci, time.Time{}, ErrInvalidToken
+	}
+
+	ts, err := strconv.ParseInt(values.Get("ts"), 10, 64)
+	if err != nil {
+		log.WithFields(log.Fields{"token": token, "error": err}).Error("invalid timestamp in v1 token")
+		return uci, time.Time{}, ErrInvalidToken
+	}
+	tokenTime := time.Unix(ts, 0)
+	if now.Sub(tokenTime) > v.Window {
+		log.Error("stale token")
+		return uci, time.Time{}, ErrStaleToken
+	}
+
+	h := hmac.New(newHash, secret)
+	h.Write([]byte(signedPrefix))
+	sum := fmt.Sprintf("%x", h.Sum(nil))
+	if sum != mac {
+		log.WithFields(log.Fields{
+			"token":      token,
+			"expected":   mac,
+			"calculated": sum,
+		}).Error("v1 token HMAC doesn't match")
+		return uci, time.Time{}, ErrInvalidToken
+	}
+
+	return uci, tokenTime.Add(v.Window), nil
+}
@@ -0,0 +1,89 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func v1Token(secret []byte, kid string, fields url.Values) string {
+	fields.Set("v", "1")
+	fields.Set("alg", "HS256")
+	fields.Set("kid", kid)
+	prefix := "v=1&" + fields.Encode()
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(prefix))
+	mac := fmt.Sprintf("%x", h.Sum(nil))
+	return prefix + "&mac=" + mac
+}
+
+func TestV1VerifierAccepts(t *testing.T) {
+	keys := NewKeyRing(map[string]string{"2024-01": "sekrit"}, "2024-01")
+	v := NewV1Verifier(keys, 60*time.Second)
+	now := time.Unix(1000, 0)
+	token := v1Token([]byte("sekrit"), "2024-01", url.Values{
+		"uni": {"gobot"}, "sub": {"gobot.browser"}, "pub": {"anp8"},
+		"ts": {fmt.Sprintf("%d", now.Unix())}, "salt": {"667494"},
+	})
+
+	uci, _, err := v.Verify(token, now, nil)
+	if err != nil {
+		t.Fatalf("expected valid token to verify, got %v", err)
+	}
+	if uci.Uni != "gobot" {
+		t.Fatalf("unexpected connection info: %+v", uci)
+	}
+}
+
+func TestV1VerifierRejectsTamperedMAC(t *testing.T) {
+	keys := NewKeyRing(map[string]string{"2024-01": "sekrit"}, "2024-01")
+	v := NewV1Verifier(keys, 60*time.Second)
+	now := time.Unix(1000, 0)
+	token := v1Token([]byte("sekrit"), "2024-01", url.Values{
+		"uni": {"gobot"}, "ts": {fmt.Sprintf("%d", now.Unix())}, "salt": {"667494"},
+	})
+	tampered := token[:len(token)-1] + "0"
+
+	if _, _, err := v.Verify(tampered, now, nil); err != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken for tampered MAC, got %v", err)
+	}
+}
+
+func TestV1VerifierRejectsUnknownKid(t *testing.T) {
+	keys := NewKeyRing(map[string]string{"2024-01": "sekrit"}, "2024-01")
+	v := NewV1Verifier(keys, 60*time.Second)
+	now := time.Unix(1000, 0)
+	token := v1Token([]byte("sekrit"), "2099-01", url.Values{
+		"uni": {"gobot"}, "ts": {fmt.Sprintf("%d", now.Unix())}, "salt": {"667494"},
+	})
+
+	if _, _, err := v.Verify(token, now, nil); err != ErrUnknownKey {
+		t.Fatalf("expected ErrUnknownKey, got %v", err)
+	}
+}
+
+func TestV1VerifierRejectsUnsupportedAlg(t *testing.T) {
+	keys := NewKeyRing(map[string]string{"2024-01": "sekrit"}, "2024-01")
+	v := NewV1Verifier(keys, 60*time.Second)
+	token := "v=1&alg=HS1&kid=2024-01&uni=gobot&ts=1000&salt=667494&mac=deadbeef"
+
+	if _, _, err := v.Verify(token, time.Unix(1000, 0), nil); err != ErrUnsupportedAlg {
+		t.Fatalf("expected ErrUnsupportedAlg, got %v", err)
+	}
+}
+
+func TestV1VerifierRejectsStaleToken(t *testing.T) {
+	keys := NewKeyRing(map[string]string{"2024-01": "sekrit"}, "2024-01")
+	v := NewV1Verifier(keys, 60*time.Second)
+	issued := time.Unix(1000, 0)
+	token := v1Token([]byte("sekrit"), "2024-01", url.Values{
+		"uni": {"gobot"}, "ts": {fmt.Sprintf("%d", issued.Unix())}, "salt": {"667494"},
+	})
+
+	if _, _, err := v.Verify(token, issued.Add(time.Hour), nil); err != ErrStaleToken {
+		t.Fatalf("expected ErrStaleToken, got %v", err)
+	}
+}
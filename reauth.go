@@ -0,0 +1,120 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+
+	"github.com/nikolas/windsock/pkg/auth"
+)
+
+// codes 4001/4002 are in the private-use range (4000-4999) reserved by
+// RFC 6455 for applications.
+const (
+	closeReauthFailed = 4001
+	closeKicked       = 4002
+)
+
+// closeWriteWait bounds how long forceDisconnect waits for the close
+// frame to go out before tearing down the connection outright.
+const closeWriteWait = 2 * time.Second
+
+const (
+	reauthMinBackoff = 1 * time.Second
+	reauthMaxBackoff = 30 * time.Second
+)
+
+// jittered returns d scaled by a random factor in [0.75, 1.25), so that
+// many connections opened around the same time don't all re-check in
+// lockstep.
+func jittered(d time.Duration) time.Duration {
+	if d <= 0 {
+		return d
+	}
+	return d/4*3 + time.Duration(rand.Int63n(int64(d)/2))
+}
+
+// expiryAuthzChecker is the ready-made checker effectiveAuthzChecker
+// hands out as the no-ReauthURL default for JWTs.
+var expiryAuthzChecker auth.AuthzChecker = auth.ExpiryAuthzChecker{}
+
+// effectiveAuthzChecker picks the AuthzChecker a connection using this
+// token version should be re-checked against, or nil to skip periodic
+// reauth entirely. An explicitly configured authzChecker (ReauthURL)
+// applies to every version, since an HTTP round-trip doesn't depend on
+// the token's embedded expiry at all. Absent that, expiryAuthzChecker
+// is only a valid default for jwt tokens: v0 and v1's Expiry is just
+// tokenTime+AUTH_WINDOW, the end of the token's one-shot freshness
+// window at verification time, not a session lifetime — applying
+// expiryAuthzChecker to them would disconnect a perfectly healthy
+// client within about a minute of it connecting.
+func effectiveAuthzChecker(version string) auth.AuthzChecker {
+	if authzChecker != nil {
+		return authzChecker
+	}
+	if version == "jwt" {
+		return expiryAuthzChecker
+	}
+	return nil
+}
+
+// reauthLoop periodically re-verifies that this connection is still
+// authorized via checker, disconnecting the client if it no longer is.
+// It exits once this.done is closed, which happens as part of the
+// normal connection teardown in BuildConnection.
+func (this *OnlineUser) reauthLoop(checker auth.AuthzChecker, interval time.Duration) {
+	backoff := reauthMinBackoff
+	timer := time.NewTimer(jittered(interval))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-this.done:
+			return
+		case <-timer.C:
+		}
+
+		refreshed, err := checker.Check(this.Uci, this.Expiry, time.Now())
+		switch {
+		case err == auth.ErrAuthzDenied:
+			log.WithFields(log.Fields{"uni": this.Uci.Uni}).Info("reauth denied, disconnecting")
+			numReauthFailures.Add(1)
+			this.forceDisconnect(closeReauthFailed, "reauth failed")
+			return
+		case err != nil:
+			log.WithFields(log.Fields{"uni": this.Uci.Uni, "error": err}).Warn("reauth check failed, backing off")
+			numReauthFailures.Add(1)
+			timer.Reset(backoff)
+			backoff *= 2
+			if backoff > reauthMaxBackoff {
+				backoff = reauthMaxBackoff
+			}
+			continue
+		case refreshed.SubPrefix != this.Uci.SubPrefix || refreshed.PubPrefix != this.Uci.PubPrefix:
+			log.WithFields(log.Fields{"uni": this.Uci.Uni}).Info("permissions changed, disconnecting")
+			numReauthFailures.Add(1)
+			this.forceDisconnect(closeReauthFailed, "reauth failed")
+			return
+		}
+
+		backoff = reauthMinBackoff
+		timer.Reset(jittered(interval))
+	}
+}
+
+// forceDisconnect sends a proper RFC 6455 close frame carrying code and
+// reason, then tears down the connection so that PullFromClient (or
+// the signaling read loop) unwinds and the normal teardown path
+// removes this user from whichever room(s) it was in. It's safe to
+// call more than once (e.g. a slow-client eviction racing a reauth
+// failure): only the first call takes effect.
+func (this *OnlineUser) forceDisconnect(code int, reason string) {
+	this.disconnectOnce.Do(func() {
+		log.WithFields(log.Fields{"uni": this.Uci.Uni, "code": code, "reason": reason}).Info("forcing disconnect")
+		msg := websocket.FormatCloseMessage(code, reason)
+		this.Connection.WriteControl(websocket.CloseMessage, msg, time.Now().Add(closeWriteWait))
+		this.Connection.Close()
+	})
+}
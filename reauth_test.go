@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/nikolas/windsock/pkg/auth"
+)
+
+func TestEffectiveAuthzCheckerDefaultsOnlyApplyToJWT(t *testing.T) {
+	defer func(prev auth.AuthzChecker) { authzChecker = prev }(authzChecker)
+	authzChecker = nil
+
+	for _, version := range []string{"v0", "v1-HS256", "v1-HS512", "v1"} {
+		if got := effectiveAuthzChecker(version); got != nil {
+			t.Errorf("version %q: expected no default reauth checker (v0/v1's Expiry isn't a session lifetime), got %v", version, got)
+		}
+	}
+	if got := effectiveAuthzChecker("jwt"); got != expiryAuthzChecker {
+		t.Errorf("version jwt: expected the expiryAuthzChecker default, got %v", got)
+	}
+}
+
+func TestEffectiveAuthzCheckerPrefersConfiguredChecker(t *testing.T) {
+	defer func(prev auth.AuthzChecker) { authzChecker = prev }(authzChecker)
+	configured := auth.NewHTTPAuthzChecker("http://unused.invalid", time.Second)
+	authzChecker = configured
+
+	for _, version := range []string{"v0", "v1-HS256", "jwt"} {
+		if got := effectiveAuthzChecker(version); got != configured {
+			t.Errorf("version %q: expected the explicitly configured checker regardless of version, got %v", version, got)
+		}
+	}
+}
+
+func v0TestToken(secret []byte, uni string, ts int64) string {
+	h := hmac.New(sha1.New, secret)
+	h.Write([]byte(fmt.Sprintf("%s:%s:%s:%d:%s:%s", uni, "sub", "pub", ts, "salt", "1.2.3.4")))
+	mac := fmt.Sprintf("%x", h.Sum(nil))
+	return fmt.Sprintf("%s:%s:%s:%d:%s:%s:%s", uni, "sub", "pub", ts, "salt", "1.2.3.4", mac)
+}
+
+// TestV0ConnectionSurvivesDefaultReauth is an end-to-end regression test
+// for the bug fixed alongside effectiveAuthzChecker: a v0 connection
+// relying on the no-ReauthURL default must not be torn down by the
+// first reauth tick, even though its Expiry is always within
+// AUTH_WINDOW of "now" at connect time.
+func TestV0ConnectionSurvivesDefaultReauth(t *testing.T) {
+	defer func(prev auth.AuthzChecker) { authzChecker = prev }(authzChecker)
+	defer func(prev time.Duration) { reauthInterval = prev }(reauthInterval)
+	authzChecker = nil
+	reauthInterval = 50 * time.Millisecond
+
+	secret := []byte("sekrit")
+	keys := auth.NewKeyRing(map[string]string{"": string(secret)}, "")
+	v0 := auth.NewV0Verifier(keys, AUTH_WINDOW)
+	token := v0TestToken(secret, "gobot", time.Now().Unix())
+
+	InitRoom()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		uci, expiry, err := v0.Verify(token, time.Now(), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buildLegacyConnection(conn, uci, expiry, auth.Version(token))
+	}))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/?" + url.Values{"token": {token}}.Encode()
+	client, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("dial failed: %v", err)
+	}
+	defer client.Close()
+
+	// wait past several reauth ticks; a healthy v0 connection must
+	// still be open.
+	time.Sleep(5 * jittered(reauthInterval))
+
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err = client.ReadMessage()
+	if websocket.IsCloseError(err, closeReauthFailed) {
+		t.Fatalf("server disconnected a healthy v0 connection with the default reauth checker: %v", err)
+	}
+}
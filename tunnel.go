@@ -0,0 +1,416 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+)
+
+// a raw TCP tunnel over the websocket lets a token grant access to a
+// backend host:port without going through pub/sub routing at all.
+
+var (
+	numTunnelsOpened  = expvar.NewInt("NumTunnelsOpened")
+	numActiveTunnels  = expvar.NewInt("NumActiveTunnels")
+	numTunnelErrors   = expvar.NewInt("NumTunnelErrors")
+	numTunnelBytesIn  = expvar.NewInt("NumTunnelBytesIn")
+	numTunnelBytesOut = expvar.NewInt("NumTunnelBytesOut")
+)
+
+// maxTunnelsPerUser bounds how many concurrent /tunnel/ connections a
+// single UNI can hold open; 0 falls back to defaultMaxTunnelsPerUser.
+var maxTunnelsPerUser = defaultMaxTunnelsPerUser
+
+const defaultMaxTunnelsPerUser = 4
+
+// tunnelIdleTimeout closes a tunnel if neither side has sent data for
+// this long. Activity on either direction counts, so a tunnel that's
+// only idle in one direction (e.g. a long download with nothing going
+// back upstream) stays open.
+var tunnelIdleTimeout = 5 * time.Minute
+
+// tunnelIdlePollInterval bounds how often pipeTunnel checks accumulated
+// idle time, and thus how often idleCopy's read deadline fires just to
+// let that check happen; it never itself closes anything.
+const tunnelIdlePollInterval = 5 * time.Second
+
+const tunnelDialTimeout = 10 * time.Second
+
+// tunnelNegotiateTimeout bounds how long BuildTunnel waits for the
+// client's first frame (the {"connect":...} control frame or a SOCKS5
+// greeting); a client that never sends one releases its tunnel slot
+// instead of holding it open forever.
+const tunnelNegotiateTimeout = 10 * time.Second
+
+var tunnelCounts = struct {
+	sync.Mutex
+	byUni map[string]int
+}{byUni: make(map[string]int)}
+
+func acquireTunnelSlot(uni string) bool {
+	tunnelCounts.Lock()
+	defer tunnelCounts.Unlock()
+	if tunnelCounts.byUni[uni] >= maxTunnelsPerUser {
+		return false
+	}
+	tunnelCounts.byUni[uni]++
+	return true
+}
+
+func releaseTunnelSlot(uni string) {
+	tunnelCounts.Lock()
+	defer tunnelCounts.Unlock()
+	tunnelCounts.byUni[uni]--
+	if tunnelCounts.byUni[uni] <= 0 {
+		delete(tunnelCounts.byUni, uni)
+	}
+}
+
+// tunnelAllowed checks target ("host:port") against a token's
+// TunnelPolicy, which may contain exact "host:port" entries or
+// "*.suffix:port" domain wildcards.
+func tunnelAllowed(target string, policy []string) bool {
+	for _, allowed := range policy {
+		if allowed == target {
+			return true
+		}
+		if startswith(allowed, "*.") {
+			host, port, err := net.SplitHostPort(target)
+			if err != nil {
+				continue
+			}
+			wantHost, wantPort, err := net.SplitHostPort(allowed)
+			if err != nil {
+				continue
+			}
+			suffix := wantHost[1:] // keep the leading dot
+			if port == wantPort && len(host) > len(suffix) && startswith(host[len(host)-len(suffix):], suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type tunnelFrame struct {
+	Connect string `json:"connect"`
+}
+
+// BuildTunnel handles a /tunnel/ websocket connection: the token must
+// grant a non-empty TunnelPolicy, the client picks a target either by
+// sending a {"connect":"host:port"} JSON frame or by speaking SOCKS5
+// directly, and from there every frame is piped to/from the dialed TCP
+// connection until either side closes.
+func BuildTunnel(ws *websocket.Conn, query url.Values) {
+	log.Info("BuildTunnel()")
+	token := query.Get("token")
+	uci, _, err := tokenVerifier.Verify(token, time.Now(), ws.RemoteAddr())
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("tunnel validation error")
+		ws.Close()
+		return
+	}
+	if len(uci.TunnelPolicy) == 0 {
+		log.WithFields(log.Fields{"uni": uci.Uni}).Error("token has no tunnel policy")
+		ws.Close()
+		return
+	}
+
+	if !acquireTunnelSlot(uci.Uni) {
+		log.WithFields(log.Fields{"uni": uci.Uni}).Error("too many concurrent tunnels")
+		numTunnelErrors.Add(1)
+		ws.Close()
+		return
+	}
+	defer releaseTunnelSlot(uci.Uni)
+
+	ws.SetReadDeadline(time.Now().Add(tunnelNegotiateTimeout))
+	target, err := negotiateTarget(ws)
+	if err != nil {
+		log.WithFields(log.Fields{"uni": uci.Uni, "error": err}).Error("tunnel negotiation failed")
+		numTunnelErrors.Add(1)
+		ws.Close()
+		return
+	}
+	ws.SetReadDeadline(time.Time{})
+
+	if !tunnelAllowed(target, uci.TunnelPolicy) {
+		log.WithFields(log.Fields{"uni": uci.Uni, "target": target}).Error("tunnel target not permitted")
+		numTunnelErrors.Add(1)
+		ws.Close()
+		return
+	}
+
+	conn, err := net.DialTimeout("tcp", target, tunnelDialTimeout)
+	if err != nil {
+		log.WithFields(log.Fields{"uni": uci.Uni, "target": target, "error": err}).Error("couldn't dial tunnel target")
+		numTunnelErrors.Add(1)
+		ws.Close()
+		return
+	}
+	defer conn.Close()
+
+	numTunnelsOpened.Add(1)
+	numActiveTunnels.Add(1)
+	defer numActiveTunnels.Add(-1)
+
+	pipeTunnel(ws, conn)
+	log.WithFields(log.Fields{"uni": uci.Uni, "target": target}).Info("tore down tunnel")
+}
+
+// negotiateTarget reads the first frame off the websocket to learn
+// which backend to dial: either a {"connect":"host:port"} control
+// frame, or the start of a SOCKS5 handshake.
+func negotiateTarget(ws *websocket.Conn) (string, error) {
+	_, first, err := ws.ReadMessage()
+	if err != nil {
+		return "", err
+	}
+	if len(first) == 0 {
+		return "", errors.New("empty tunnel control frame")
+	}
+	if first[0] == '{' {
+		var frame tunnelFrame
+		if err := json.Unmarshal(first, &frame); err != nil {
+			return "", err
+		}
+		if frame.Connect == "" {
+			return "", errors.New("tunnel control frame missing connect target")
+		}
+		return frame.Connect, nil
+	}
+	return negotiateSOCKS5(ws, first)
+}
+
+// negotiateSOCKS5 drives a minimal SOCKS5 handshake (no-auth only,
+// CONNECT command only) over the websocket, returning the requested
+// "host:port" target. greeting is the first frame already read by the
+// caller.
+func negotiateSOCKS5(ws *websocket.Conn, greeting []byte) (string, error) {
+	if len(greeting) < 2 || greeting[0] != 0x05 {
+		return "", errors.New("invalid socks5 greeting")
+	}
+	nmethods := int(greeting[1])
+	if len(greeting) < 2+nmethods {
+		return "", errors.New("truncated socks5 greeting")
+	}
+
+	if err := ws.WriteMessage(websocket.BinaryMessage, []byte{0x05, 0x00}); err != nil { // no auth required
+		return "", err
+	}
+
+	_, req, err := ws.ReadMessage()
+	if err != nil {
+		return "", err
+	}
+	if len(req) < 4 || req[0] != 0x05 || req[1] != 0x01 {
+		return "", errors.New("unsupported socks5 command")
+	}
+
+	var host string
+	var rest []byte
+	switch req[3] {
+	case 0x01: // IPv4
+		if len(req) < 4+net.IPv4len+2 {
+			return "", errors.New("truncated socks5 request")
+		}
+		host = net.IP(req[4 : 4+net.IPv4len]).String()
+		rest = req[4+net.IPv4len:]
+	case 0x03: // domain name
+		if len(req) < 5 {
+			return "", errors.New("truncated socks5 request")
+		}
+		l := int(req[4])
+		if len(req) < 5+l+2 {
+			return "", errors.New("truncated socks5 request")
+		}
+		host = string(req[5 : 5+l])
+		rest = req[5+l:]
+	case 0x04: // IPv6
+		if len(req) < 4+net.IPv6len+2 {
+			return "", errors.New("truncated socks5 request")
+		}
+		host = net.IP(req[4 : 4+net.IPv6len]).String()
+		rest = req[4+net.IPv6len:]
+	default:
+		return "", errors.New("unsupported socks5 address type")
+	}
+	port := int(rest[0])<<8 | int(rest[1])
+
+	// bind address is meaningless for our purposes; report 0.0.0.0:0
+	if err := ws.WriteMessage(websocket.BinaryMessage, []byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0}); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(port)), nil
+}
+
+// deadlineReader is the subset of net.Conn / wsByteStream that
+// idleCopy needs to reset an idle timeout on every read.
+type deadlineReader interface {
+	io.Reader
+	SetReadDeadline(time.Time) error
+}
+
+// wsByteStream adapts gorilla/websocket's message-oriented Conn into a
+// plain io.Reader/io.Writer byte stream, so the tunnel can be piped
+// with the same idleCopy used for the net.Conn side. Each websocket
+// frame is treated as a chunk of the stream; partial reads carry the
+// remainder of a frame over to the next Read call.
+type wsByteStream struct {
+	conn *websocket.Conn
+	rest []byte
+}
+
+func (s *wsByteStream) Read(p []byte) (int, error) {
+	for len(s.rest) == 0 {
+		_, data, err := s.conn.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		s.rest = data
+	}
+	n := copy(p, s.rest)
+	s.rest = s.rest[n:]
+	return n, nil
+}
+
+func (s *wsByteStream) Write(p []byte) (int, error) {
+	if err := s.conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// SetReadDeadline leaves the websocket's own read deadline untouched:
+// gorilla/websocket treats a read timeout as fatal to the connection,
+// so a poll deadline here would end the tunnel on the first quiet poll
+// interval. The websocket side's idleness is enforced by
+// watchTunnelIdle closing ws instead.
+func (s *wsByteStream) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// tunnelActivity tracks the most recent read, in either direction, of
+// a single tunnel, so idleness can be judged across both goroutines of
+// pipeTunnel instead of each one closing the whole tunnel on its own.
+type tunnelActivity struct {
+	lastNano int64
+}
+
+func newTunnelActivity() *tunnelActivity {
+	return &tunnelActivity{lastNano: time.Now().UnixNano()}
+}
+
+func (a *tunnelActivity) touch() {
+	atomic.StoreInt64(&a.lastNano, time.Now().UnixNano())
+}
+
+func (a *tunnelActivity) idleFor() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&a.lastNano)))
+}
+
+// isTimeout reports whether err is a deadline-exceeded error, as
+// opposed to the connection actually closing.
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// idleCopy is io.Copy with a read deadline of pollInterval, so src.Read
+// wakes up periodically and lets activity.touch() run on real traffic;
+// a timeout here just means "nothing to report yet", not "idle" — the
+// actual idle decision belongs to watchTunnelIdle, which sees both
+// directions at once. A pollInterval of 0 disables the deadline
+// entirely (tunnelIdleTimeout <= 0, i.e. idle timeout disabled).
+func idleCopy(dst io.Writer, src deadlineReader, pollInterval time.Duration, counter *expvar.Int, activity *tunnelActivity) error {
+	buf := make([]byte, 32*1024)
+	for {
+		if pollInterval > 0 {
+			src.SetReadDeadline(time.Now().Add(pollInterval))
+		}
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, werr := dst.Write(buf[:n]); werr != nil {
+				return werr
+			}
+			counter.Add(int64(n))
+			activity.touch()
+		}
+		if err != nil {
+			if pollInterval > 0 && isTimeout(err) {
+				continue
+			}
+			return err
+		}
+	}
+}
+
+// watchTunnelIdle closes both halves of a tunnel once activity reports
+// neither direction has seen traffic for tunnelIdleTimeout, and exits
+// without doing so once stop fires (pipeTunnel tore the tunnel down
+// for some other reason first).
+func watchTunnelIdle(conn net.Conn, ws *websocket.Conn, activity *tunnelActivity, pollInterval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if activity.idleFor() >= tunnelIdleTimeout {
+				conn.Close()
+				ws.Close()
+				return
+			}
+		}
+	}
+}
+
+// pipeTunnel shovels bytes in both directions between ws and conn
+// until one side closes, at which point the other is closed too so
+// neither goroutine blocks forever. Idleness is judged across both
+// directions together (see tunnelActivity/watchTunnelIdle), so a
+// tunnel that's busy in one direction isn't torn down just because the
+// other has nothing to send.
+func pipeTunnel(ws *websocket.Conn, conn net.Conn) {
+	stream := &wsByteStream{conn: ws}
+	activity := newTunnelActivity()
+
+	pollInterval := tunnelIdlePollInterval
+	if tunnelIdleTimeout <= 0 {
+		pollInterval = 0
+	} else if tunnelIdleTimeout < pollInterval {
+		pollInterval = tunnelIdleTimeout
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		idleCopy(conn, stream, pollInterval, numTunnelBytesIn, activity)
+		conn.Close()
+		done <- struct{}{}
+	}()
+	go func() {
+		idleCopy(stream, conn, pollInterval, numTunnelBytesOut, activity)
+		ws.Close()
+		done <- struct{}{}
+	}()
+
+	stop := make(chan struct{})
+	if tunnelIdleTimeout > 0 {
+		go watchTunnelIdle(conn, ws, activity, pollInterval, stop)
+	}
+
+	<-done
+	<-done
+	close(stop)
+}
@@ -1,31 +1,47 @@
 package main
 
 import (
-	"crypto/hmac"
-	"crypto/sha1"
 	"encoding/json"
-	"errors"
 	"expvar"
 	"flag"
-	"fmt"
 	"io/ioutil"
-	"net"
 	"net/http"
-	"strconv"
-	"strings"
+	"net/url"
+	"sync"
 	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
 	"github.com/kelseyhightower/envconfig"
 	zmq "github.com/pebbe/zmq2"
-	"golang.org/x/net/websocket"
-)
 
-// obviously, this should not be hard-coded in real life:
-var SECRET = "6f1d916c-7761-4874-8d5b-8f8f93d20bf2"
+	"github.com/nikolas/windsock/pkg/auth"
+)
 
 var AUTH_WINDOW = 60 * time.Second
 
+// tokenVerifier is wired up in main() from ConfigData and dispatches
+// incoming tokens to the v0/v1/JWT verifier in pkg/auth that matches.
+var tokenVerifier auth.TokenVerifier
+
+// breakdown of verified tokens by version/algorithm, e.g. "v0", "v1-HS256", "jwt"
+var numTokensByVersion = expvar.NewMap("NumTokensByVersion")
+
+// authzChecker, if set (from ReauthURL), re-verifies authorization on
+// a timer for every connected user regardless of token version; nil
+// means there's no externally configured checker, in which case
+// effectiveAuthzChecker decides per-connection whether a default
+// applies.
+var authzChecker auth.AuthzChecker
+
+// how often each connection re-checks its authorization
+var reauthInterval = 60 * time.Second
+
+// periodic re-authorization checks that failed: denials and permission
+// changes (which close the connection) as well as transient checker
+// errors (which are retried with backoff)
+var numReauthFailures = expvar.NewInt("NumReauthFailures")
+
 var startTime = time.Now().UTC()
 
 // metrics
@@ -78,7 +94,7 @@ func (r *room) run() {
 	for e := range r.Broadcast {
 		for u := range r.Users {
 			if e.RouteTo(u) {
-				u.Send <- e
+				u.Enqueue(e)
 			}
 		}
 	}
@@ -100,141 +116,71 @@ func InitRoom() {
 
 type OnlineUser struct {
 	Connection *websocket.Conn
-	Uci        userConnectionInfo
-	Send       chan envelope
-}
-
-// loop indefinitely, taking messages on a channel
-// and sending them out to the user's websocket
-func (this *OnlineUser) PushToClient() {
-	for e := range this.Send {
-		err := websocket.JSON.Send(this.Connection, e)
-		log.Info("sent websocket message")
-		if err != nil {
-			break
-		}
-	}
+	Uci        auth.ConnectionInfo
+	Expiry     time.Time
+	Send       chan interface{}
+	done       chan struct{}
+
+	// disconnectOnce guards forceDisconnect against being run twice,
+	// e.g. a slow-client eviction racing a reauth failure.
+	disconnectOnce sync.Once
 }
 
 // loop indefinitely listening for incoming
 // messages from a user's websocket
 func (this *OnlineUser) PullFromClient() {
+	compressAllowed := hasPermission(this.Uci, "compress")
+	this.Connection.SetReadDeadline(time.Now().Add(pongWait))
+	this.Connection.SetPongHandler(func(string) error {
+		this.Connection.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
 	for {
-		var content string
-		err := websocket.Message.Receive(this.Connection, &content)
-
+		_, data, err := this.Connection.ReadMessage()
 		if err != nil {
 			return
 		}
+		recordIncomingBytes(len(data), compressAllowed)
+		content := string(data)
 		log.Info("incoming:", content)
 		runningRoom.Incoming <- envelope{this.Uci.PubPrefix, content}
 	}
 }
 
-type userConnectionInfo struct {
-	Uni       string
-	SubPrefix string
-	PubPrefix string
-}
-
-// improvements that should be made:
-// * include hash function name in the token (so we can swap it in the future)
-// * include a version number in the token (to enable backwards compatability)
-// * allow a mode where IP address isn't checked
-
-func validateToken(token string, current_time time.Time,
-	remote_ip net.Addr, uci *userConnectionInfo) error {
-	// token will look something like this:
-	// anp8:gobot:gobot.browser.anp8:1344361884:667494:127.0.0.1:306233f64522f1f970fc62fb3cf2d7320c899851
-	parts := strings.Split(token, ":")
-	if len(parts) != 7 {
-		log.WithFields(
-			log.Fields{
-				"token": token,
-				"parts": len(parts),
-			}).Error("couldn't parse token")
-		return errors.New("invalid token")
-	}
-	// their UNI
-	uni := parts[0]
-	sub_prefix := parts[1]
-	pub_prefix := parts[2]
-	uci.Uni = uni
-	uci.SubPrefix = sub_prefix
-	uci.PubPrefix = pub_prefix
-	// UNIX timestamp
-	now, err := strconv.Atoi(parts[3])
-	if err != nil {
-		log.WithFields(log.Fields{
-			"token":           token,
-			"timestamp_field": parts[3],
-			"now":             now,
-			"error":           err,
-		}).Error("invalid timestamp in token")
-		return errors.New("invalid timestamp in token")
-	}
-	// a random salt
-	salt := parts[4]
-	ip_address := parts[5]
-	// the hmac of those parts with our shared secret
-	hmc := parts[6]
-	// make sure we're within a 60 second window
-	token_time := time.Unix(int64(now), 0)
-	if current_time.Sub(token_time) > time.Duration(AUTH_WINDOW) {
-		log.Error("stale token")
-		return errors.New("stale token")
-	}
-
-	// TODO: check that their ip address matches
-	// PROBLEM: remote_ip is something like: "http://127.0.0.1:8000"
-	// instead of "127.0.0.1", so we still need to figure out how
-	// to get the IP address out of there (and make sure it is the right
-	// end of the connection)
-
-	//	if remote_ip.String() != ip_address {
-	//		fmt.Printf("%s %s\n",remote_ip.String(), ip_address)
-	//		return uni, errors.New("remote address doesn't match token")
-	//	}
-
-	// check that the HMAC matches
-	h := hmac.New(sha1.New, []byte(SECRET))
-	h.Write([]byte(fmt.Sprintf("%s:%s:%s:%d:%s:%s", uni, sub_prefix, pub_prefix, now, salt, ip_address)))
-	sum := fmt.Sprintf("%x", h.Sum(nil))
-	if sum != hmc {
-		log.WithFields(log.Fields{
-			"token":      token,
-			"expected":   hmc,
-			"calculated": sum,
-		}).Error("token HMAC doesn't match")
-		return errors.New("token HMAC doesn't match")
-	}
-	return nil
-}
-
-func BuildConnection(ws *websocket.Conn) {
+// BuildConnection dispatches an already-verified connection to one of
+// two protocols: the original implicit sub-prefix routing (opted into
+// with ?protocol=legacy, for existing clients) or the default
+// room-based JSON control plane handled by the Hub. The token is
+// verified up front by upgradeAndServeCompressed, since it also needs
+// uci to decide whether to negotiate compression before upgrading;
+// version is that same token's auth.Version, needed to pick the right
+// reauth checker (see effectiveAuthzChecker).
+func BuildConnection(ws *websocket.Conn, uci auth.ConnectionInfo, expiry time.Time, version string, query url.Values) {
 	log.Info("BuildConnection()")
-	token := ws.Request().URL.Query().Get("token")
-	log.Debug(token)
-	var uci userConnectionInfo
-	err := validateToken(token, time.Now(), ws.RemoteAddr(), &uci)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"error": err,
-		}).Error("validation error")
-		// how should this reply to the client?
+	if query.Get("protocol") == "legacy" {
+		buildLegacyConnection(ws, uci, expiry, version)
 		return
 	}
+	buildSignalingConnection(ws, uci, expiry, version)
+}
 
+func buildLegacyConnection(ws *websocket.Conn, uci auth.ConnectionInfo, expiry time.Time, version string) {
 	onlineUser := &OnlineUser{
 		Connection: ws,
 		Uci:        uci,
-		Send:       make(chan envelope, 256),
+		Expiry:     expiry,
+		Send:       make(chan interface{}, sendQueueSize),
+		done:       make(chan struct{}),
 	}
 	runningRoom.Users[onlineUser] = true
 	numClients.Add(1)
 	totalClients.Add(1)
 	go onlineUser.PushToClient()
+	if checker := effectiveAuthzChecker(version); checker != nil {
+		go onlineUser.reauthLoop(checker, reauthInterval)
+	}
 	onlineUser.PullFromClient()
+	close(onlineUser.done)
 	delete(runningRoom.Users, onlineUser)
 	numClients.Add(-1)
 	log.Info("tore down user connection")
@@ -251,6 +197,7 @@ func zmqToWebsocket(subsocket zmq.Socket) {
 			"content": string(content),
 		}).Info("received a zmq message")
 		runningRoom.SendMessage(envelope{string(address), string(content)})
+		runningHub.broadcast(string(address), roomMessage{Type: "message", Room: string(address), From: "zmq", Content: string(content)}, nil)
 		numMessages.Add(1)
 	}
 }
@@ -274,14 +221,51 @@ func websocketToZmq(reqsocket zmq.Socket) {
 
 type ConfigData struct {
 	Secret        string
+	Secrets       map[string]string
+	JWKSURL       string
 	SubSocket     string
 	ReqSocket     string
 	WebSocketPort string
 	SubKey        string
 	Certificate   string
 	Key           string
+
+	// ReauthURL, if set, enables periodic re-authorization checks
+	// against that endpoint every ReauthInterval seconds (default 60),
+	// each bounded by ReauthTimeout seconds (default 5).
+	ReauthURL      string
+	ReauthInterval int
+	ReauthTimeout  int
+
+	// MaxTunnelsPerUser and TunnelIdleTimeout (seconds) bound the
+	// /tunnel/ handler; both default if left at zero.
+	MaxTunnelsPerUser int
+	TunnelIdleTimeout int
+
+	// CompressionLevel (1-9, gzip/flate style) and MinCompressSize
+	// (bytes) tune permessage-deflate; both default if left at zero.
+	// Compression is only ever applied to connections whose token
+	// carries the "compress" permission.
+	CompressionLevel int
+	MinCompressSize  int
+
+	// WriteWait and PongWait (seconds) bound, respectively, how long a
+	// single write (including a ping) may take and how long we'll wait
+	// for a pong before considering a connection dead. PingPeriod
+	// (seconds) overrides the default of 9/10 of PongWait. SendQueueSize
+	// bounds how many outbound messages a client may have buffered
+	// before it's evicted as too slow to keep up. All default if left
+	// at zero.
+	WriteWait     int
+	PongWait      int
+	PingPeriod    int
+	SendQueueSize int
 }
 
+// legacyKid is the key id that the legacy v0 verifier and any v1
+// tokens without their own kid are checked against.
+const legacyKid = ""
+
 type config struct {
 	LogLevel string `envconfig:"LOG_LEVEL"`
 }
@@ -302,7 +286,61 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	SECRET = f.Secret
+	secrets := make(map[string]string, len(f.Secrets)+1)
+	for kid, secret := range f.Secrets {
+		secrets[kid] = secret
+	}
+	secrets[legacyKid] = f.Secret
+	keys := auth.NewKeyRing(secrets, legacyKid)
+
+	var jwtVerifier auth.TokenVerifier
+	if f.JWKSURL != "" {
+		jwtVerifier = auth.NewJWTVerifier(f.JWKSURL, 5*time.Minute)
+	}
+	tokenVerifier = auth.NewDispatcher(
+		auth.NewV0Verifier(keys, AUTH_WINDOW),
+		auth.NewV1Verifier(keys, AUTH_WINDOW),
+		jwtVerifier,
+	)
+
+	if f.ReauthURL != "" {
+		timeout := time.Duration(f.ReauthTimeout) * time.Second
+		if timeout <= 0 {
+			timeout = 5 * time.Second
+		}
+		authzChecker = auth.NewHTTPAuthzChecker(f.ReauthURL, timeout)
+	}
+	// absent an explicit ReauthURL, effectiveAuthzChecker still falls
+	// back to re-checking expiry for JWTs, which carry a real
+	// session-length expiry unlike v0/v1 (see effectiveAuthzChecker).
+	if f.ReauthInterval > 0 {
+		reauthInterval = time.Duration(f.ReauthInterval) * time.Second
+	}
+	if f.MaxTunnelsPerUser > 0 {
+		maxTunnelsPerUser = f.MaxTunnelsPerUser
+	}
+	if f.TunnelIdleTimeout > 0 {
+		tunnelIdleTimeout = time.Duration(f.TunnelIdleTimeout) * time.Second
+	}
+	if f.CompressionLevel > 0 {
+		compressionLevel = f.CompressionLevel
+	}
+	if f.MinCompressSize > 0 {
+		minCompressSize = f.MinCompressSize
+	}
+	if f.WriteWait > 0 {
+		writeWait = time.Duration(f.WriteWait) * time.Second
+	}
+	if f.PongWait > 0 {
+		pongWait = time.Duration(f.PongWait) * time.Second
+		pingPeriod = pongWait * 9 / 10
+	}
+	if f.PingPeriod > 0 {
+		pingPeriod = time.Duration(f.PingPeriod) * time.Second
+	}
+	if f.SendQueueSize > 0 {
+		sendQueueSize = f.SendQueueSize
+	}
 
 	var c config
 	err = envconfig.Process("windsock", &c)
@@ -338,7 +376,8 @@ func main() {
 	go websocketToZmq(*reqsocket)
 	go zmqToWebsocket(*subsocket)
 
-	http.Handle("/socket/", websocket.Handler(BuildConnection))
+	http.HandleFunc("/socket/", upgradeAndServeCompressed(BuildConnection))
+	http.HandleFunc("/tunnel/", upgradeAndServe(BuildTunnel))
 
 	expvar.Publish("Uptime", expvar.Func(uptime))
 	if f.Certificate != "" && f.Key != "" {
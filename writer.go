@@ -0,0 +1,105 @@
+package main
+
+import (
+	"expvar"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+)
+
+// writeWait bounds how long a single write (including pings) may take
+// before the connection is considered dead.
+var writeWait = 10 * time.Second
+
+// pongWait bounds how long we'll wait for a pong (or any other client
+// traffic) before giving up on the connection; pingPeriod must stay
+// comfortably under it.
+var pongWait = 60 * time.Second
+
+// pingPeriod is how often PushToClient sends a ping to keep the
+// connection alive and detect a dead peer before pongWait expires.
+var pingPeriod = pongWait * 9 / 10
+
+// sendQueueSize bounds how many outbound messages may be buffered for
+// a single client before it's considered too slow to keep up and is
+// evicted rather than allowed to stall the broadcaster.
+var sendQueueSize = 256
+
+var (
+	numSlowClientsEvicted = expvar.NewInt("NumSlowClientsEvicted")
+	numWriteTimeouts      = expvar.NewInt("NumWriteTimeouts")
+
+	// sendQueueDepthHist buckets Enqueue's observed queue depth (as a
+	// percentage of sendQueueSize) at the moment each message is
+	// accepted, so operators can see how close clients run to eviction.
+	sendQueueDepthHist = expvar.NewMap("SendQueueDepthHistogram")
+)
+
+// recordQueueDepth buckets depth/capacity into one of four quartiles.
+func recordQueueDepth(depth, capacity int) {
+	if capacity <= 0 {
+		return
+	}
+	switch pct := depth * 100 / capacity; {
+	case pct < 25:
+		sendQueueDepthHist.Add("0-25", 1)
+	case pct < 50:
+		sendQueueDepthHist.Add("25-50", 1)
+	case pct < 75:
+		sendQueueDepthHist.Add("50-75", 1)
+	default:
+		sendQueueDepthHist.Add("75-100", 1)
+	}
+}
+
+// Enqueue hands msg to this user's outbound queue without ever
+// blocking the caller (a room or hub broadcast fan-out). If the queue
+// is full the client is too slow to keep up: it's evicted with a 1008
+// (policy violation) close instead of stalling everyone else. Returns
+// false if the message was dropped.
+func (this *OnlineUser) Enqueue(msg interface{}) bool {
+	select {
+	case this.Send <- msg:
+		recordQueueDepth(len(this.Send), cap(this.Send))
+		return true
+	default:
+		log.WithFields(log.Fields{"uni": this.Uci.Uni}).Warn("evicting slow client, send queue full")
+		numSlowClientsEvicted.Add(1)
+		this.forceDisconnect(websocket.ClosePolicyViolation, "too slow")
+		return false
+	}
+}
+
+// loop indefinitely, taking messages on a channel and sending them out
+// to the user's websocket, pinging on pingPeriod to keep the
+// connection alive and detect a dead peer via writeWait.
+func (this *OnlineUser) PushToClient() {
+	compressAllowed := hasPermission(this.Uci, "compress")
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-this.done:
+			return
+		case e := <-this.Send:
+			this.Connection.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := writeMessage(this.Connection, e, compressAllowed); err != nil {
+				log.WithFields(log.Fields{"uni": this.Uci.Uni, "error": err}).Info("write failed, evicting client")
+				numWriteTimeouts.Add(1)
+				this.forceDisconnect(websocket.ClosePolicyViolation, "write failed")
+				return
+			}
+			log.Info("sent websocket message")
+		case <-ticker.C:
+			this.Connection.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := this.Connection.WriteMessage(websocket.PingMessage, nil); err != nil {
+				log.WithFields(log.Fields{"uni": this.Uci.Uni, "error": err}).Info("ping failed, evicting client")
+				numWriteTimeouts.Add(1)
+				this.forceDisconnect(websocket.ClosePolicyViolation, "ping failed")
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/url"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+
+	"github.com/nikolas/windsock/pkg/auth"
+)
+
+// upgrader never negotiates permessage-deflate; it's used for
+// connections that never compress: /tunnel/ connections, which have no
+// per-token notion of "compress", and /socket/ connections whose token
+// lacks the "compress" permission, for which writeMessage always
+// disables write compression. Offering the extension to them would
+// just be wasted handshake overhead.
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// compressingUpgrader is the same as upgrader but negotiates RFC 7692
+// permessage-deflate; it's only used for /socket/ connections whose
+// token carries the "compress" permission, so compression is opt-in
+// per token even at the handshake level, not just per message.
+var compressingUpgrader = websocket.Upgrader{
+	ReadBufferSize:    4096,
+	WriteBufferSize:   4096,
+	EnableCompression: true,
+	CheckOrigin:       func(r *http.Request) bool { return true },
+}
+
+// compressionLevel is passed through to gorilla/websocket's flate
+// writer. It's the closest equivalent this library exposes to
+// "window bits": gorilla/websocket negotiates client_no_context_takeover
+// and the deflate window internally and doesn't expose them as
+// server-settable knobs.
+var compressionLevel = 1
+
+// minCompressSize is the smallest marshaled message we'll bother
+// compressing; small control envelopes (joined/users/usermessage) cost
+// more CPU to deflate than they save in bytes.
+var minCompressSize = 256
+
+// These count message payload bytes (pre-compression) that were or
+// weren't *attempted* to be compressed, not actual on-wire byte
+// counts: gorilla/websocket applies compression transparently and
+// doesn't expose the compressed frame size, so there's no way to
+// measure a real compression ratio through its API. Use these to see
+// how much traffic is eligible for compression, not how many bytes it saved.
+var (
+	numCompressionEligibleBytesOut = expvar.NewInt("NumCompressionEligibleBytesOut")
+	numCompressionSkippedBytesOut  = expvar.NewInt("NumCompressionSkippedBytesOut")
+	numCompressionEligibleBytesIn  = expvar.NewInt("NumCompressionEligibleBytesIn")
+	numCompressionSkippedBytesIn   = expvar.NewInt("NumCompressionSkippedBytesIn")
+)
+
+// writeMessage marshals v and writes it as a text frame, enabling
+// per-message write compression only when compressAllowed (the
+// connection's token carries the "compress" capability) and the
+// payload clears minCompressSize.
+func writeMessage(conn *websocket.Conn, v interface{}, compressAllowed bool) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if compressAllowed && len(data) >= minCompressSize {
+		conn.EnableWriteCompression(true)
+		conn.SetCompressionLevel(compressionLevel)
+		numCompressionEligibleBytesOut.Add(int64(len(data)))
+	} else {
+		conn.EnableWriteCompression(false)
+		numCompressionSkippedBytesOut.Add(int64(len(data)))
+	}
+	return conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// upgradeAndServe adapts a (conn, query) websocket handler into a
+// plain http.HandlerFunc, performing the upgrade and handing off the
+// query string since gorilla/websocket's Conn doesn't carry the
+// original *http.Request the way golang.org/x/net/websocket's did.
+// It never negotiates compression; use upgradeAndServeCompressed for
+// connections that should.
+func upgradeAndServe(handler func(*websocket.Conn, url.Values)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("websocket upgrade failed")
+			return
+		}
+		handler(conn, r.URL.Query())
+	}
+}
+
+// upgradeAndServeCompressed verifies the request's token up front (so
+// that the decision to offer permessage-deflate can be baked into the
+// upgrade handshake itself) and upgrades with compressingUpgrader only
+// when the resulting token carries the "compress" permission,
+// otherwise falling back to the non-negotiating upgrader. handler
+// receives the already-verified connection info, plus the token's
+// auth.Version (so callers can pick the right reauth checker, see
+// effectiveAuthzChecker) so it doesn't need to verify the token again.
+func upgradeAndServeCompressed(handler func(*websocket.Conn, auth.ConnectionInfo, time.Time, string, url.Values)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		token := query.Get("token")
+		uci, expiry, err := tokenVerifier.Verify(token, time.Now(), requestAddr(r.RemoteAddr))
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("validation error")
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		version := auth.Version(token)
+		numTokensByVersion.Add(version, 1)
+
+		u := upgrader
+		if hasPermission(uci, "compress") {
+			u = compressingUpgrader
+		}
+		conn, err := u.Upgrade(w, r, nil)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("websocket upgrade failed")
+			return
+		}
+		handler(conn, uci, expiry, version, query)
+	}
+}
+
+// requestAddr adapts the plain remote-address string still available
+// pre-upgrade (gorilla/websocket's Conn.RemoteAddr is only populated
+// after Upgrade) into a net.Addr so upgradeAndServeCompressed can
+// verify a token before deciding whether to negotiate compression.
+type requestAddr string
+
+func (a requestAddr) Network() string { return "tcp" }
+func (a requestAddr) String() string  { return string(a) }
+
+// recordIncomingBytes approximates the compressed/uncompressed split
+// for inbound traffic. gorilla/websocket decompresses frames
+// transparently and doesn't expose their on-wire size, so this applies
+// the same size heuristic used by writeMessage rather than a true byte count.
+func recordIncomingBytes(size int, compressAllowed bool) {
+	if compressAllowed && size >= minCompressSize {
+		numCompressionEligibleBytesIn.Add(int64(size))
+	} else {
+		numCompressionSkippedBytesIn.Add(int64(size))
+	}
+}